@@ -0,0 +1,67 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultCommandTimeout is how long Do/DoContext wait for a command to
+// commit before giving up, unless overridden with SetCommandTimeout. It
+// matches the timeout this package always used before it became
+// configurable.
+const DefaultCommandTimeout = time.Second
+
+// The outcome of a command delivered on the channel returned by DoAsync:
+// either the value the state machine produced, or the error that prevented
+// it from committing (including CommandTimeoutError).
+type CommandResult struct {
+	Value interface{}
+	Err   error
+}
+
+// Retrieves how long a command is allowed to wait for commit before timing
+// out.
+func (s *Server) CommandTimeout() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.commandTimeout
+}
+
+// Sets how long a command is allowed to wait for commit before timing out.
+// WAN clusters or pipelined callers generally want this higher than the
+// package's historical one-second default.
+func (s *Server) SetCommandTimeout(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commandTimeout = d
+}
+
+// Appends command to the log and returns immediately with a channel that
+// delivers the commit result once replication finishes (or the command
+// times out). Unlike Do, this never blocks the caller waiting on quorum.
+func (s *Server) DoAsync(command Command) (<-chan CommandResult, error) {
+	ret, err := s.send(command)
+	if err != nil {
+		return nil, err
+	}
+
+	resultChan, _ := ret.(chan CommandResult)
+	return resultChan, nil
+}
+
+// Like Do, but takes a context for cancellation: if ctx is done before the
+// command commits, DoContext returns ctx.Err() without waiting for the
+// configured command timeout.
+func (s *Server) DoContext(ctx context.Context, command Command) (interface{}, error) {
+	resultChan, err := s.DoAsync(command)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-resultChan:
+		return result.Value, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
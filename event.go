@@ -0,0 +1,139 @@
+package raft
+
+import "time"
+
+// Event types fired on the server's event bus. Listeners are free to add
+// their own application-specific types; these are the ones the raft package
+// itself defines. All of them are fired by the package except
+// HeartbeatTimeoutEventType, which is declared but never dispatched.
+const (
+	StateChangeEventType              = "stateChange"
+	HeartbeatEventType                = "heartbeat"
+	HeartbeatTimeoutEventType         = "heartbeatTimeout"
+	ElectionTimeoutEventType          = "electionTimeout"
+	ElectionTimeoutThresholdEventType = "electionTimeoutThreshold"
+	CommitEventType                   = "commit"
+)
+
+// An Event describes a single occurrence dispatched to listeners registered
+// via AddEventListener. Value and PrevValue are type-dependent: for
+// StateChangeEventType they're the new/previous state strings, for
+// CommitEventType the new commit index, and so on.
+type Event struct {
+	Type      string
+	Value     interface{}
+	PrevValue interface{}
+}
+
+// A function invoked for every Event of the type it was registered for.
+type EventListener func(Event)
+
+// Registers a listener for the given event type. Listeners run on a
+// dedicated dispatch goroutine so a slow or misbehaving listener can't stall
+// the server's main event loop.
+func (s *Server) AddEventListener(eventType string, fn EventListener) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	if s.eventListeners == nil {
+		s.eventListeners = make(map[string][]EventListener)
+	}
+	s.eventListeners[eventType] = append(s.eventListeners[eventType], fn)
+}
+
+// Removes all listeners previously registered for the given event type.
+func (s *Server) RemoveEventListener(eventType string) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+	delete(s.eventListeners, eventType)
+}
+
+// DefaultEventQueueSize is how many dispatched events may be queued for
+// delivery before dispatchEvent starts dropping them. The size is fixed when
+// the server is constructed; there is no setter for it.
+const DefaultEventQueueSize = 256
+
+// Queues an event for delivery to every listener registered for its type.
+// Queuing (rather than spawning a goroutine per event) keeps events in
+// the order they were dispatched, which matters for callers watching the
+// StateChangeEventType feed or the Commit sequence. Delivery happens on
+// eventDispatchLoop so a slow or misbehaving listener can't stall the Raft
+// event loop; if listeners fall far enough behind that the queue fills up,
+// the event is dropped rather than blocking the caller.
+func (s *Server) dispatchEvent(e Event) {
+	s.eventMutex.RLock()
+	hasListeners := len(s.eventListeners[e.Type]) > 0
+	s.eventMutex.RUnlock()
+
+	if !hasListeners {
+		return
+	}
+
+	select {
+	case s.eventc <- e:
+	default:
+		s.debugln("server.event.dropped: ", e.Type)
+	}
+}
+
+// Delivers queued events to their listeners in dispatch order, one at a
+// time. Runs for the lifetime of the server; started from Initialize.
+func (s *Server) eventDispatchLoop() {
+	for e := range s.eventc {
+		s.eventMutex.RLock()
+		listeners := s.eventListeners[e.Type]
+		s.eventMutex.RUnlock()
+
+		for _, fn := range listeners {
+			fn(e)
+		}
+	}
+}
+
+//--------------------------------------
+// Election timeout threshold watchdog
+//--------------------------------------
+
+// DefaultElectionTimeoutThresholdPercent is the fraction of the election
+// timeout that must elapse since the last heartbeat before
+// ElectionTimeoutThresholdEventType fires, letting callers proactively warn
+// about impending leader loss instead of only finding out after the fact.
+const DefaultElectionTimeoutThresholdPercent = 0.5
+
+// Started by followerLoop, periodically checking how long it's been since
+// the last heartbeat was received and firing
+// ElectionTimeoutThresholdEventType on every tick once that reaches
+// DefaultElectionTimeoutThresholdPercent of the election timeout. Exits at
+// the first tick after the server is no longer a Follower.
+func (s *Server) electionTimeoutThresholdWatchdog() {
+	ticker := time.NewTicker(s.ElectionTimeout() / 10)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		if s.State() != Follower {
+			return
+		}
+
+		threshold := time.Duration(float64(s.ElectionTimeout()) * DefaultElectionTimeoutThresholdPercent)
+		since := time.Since(s.lastHeartbeat())
+		if since >= threshold {
+			s.dispatchEvent(Event{Type: ElectionTimeoutThresholdEventType, Value: since, PrevValue: threshold})
+		}
+	}
+}
+
+// Records the time a heartbeat was last received: any AppendEntries whose
+// term isn't stale, whether or not its entries matched the local log.
+func (s *Server) setLastHeartbeat(t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastHeartbeatAt = t
+}
+
+// Retrieves the time a heartbeat was last received.
+func (s *Server) lastHeartbeat() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lastHeartbeatAt
+}
@@ -0,0 +1,178 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileSnapshotStore is the default SnapshotStore: it keeps snapshots as
+// <term>_<index>.ss files in a directory on disk, the same layout this
+// package has always used.
+type FileSnapshotStore struct {
+	dir string
+
+	mutex  sync.Mutex
+	retain int
+}
+
+// Creates a FileSnapshotStore rooted at dir, creating it if it doesn't
+// already exist. retain is clamped to a minimum of 1.
+func NewFileSnapshotStore(dir string, retain int) (*FileSnapshotStore, error) {
+	if retain < 1 {
+		retain = 1
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSnapshotStore{dir: dir, retain: retain}, nil
+}
+
+func (store *FileSnapshotStore) idFor(lastIndex uint64, lastTerm uint64) string {
+	return fmt.Sprintf("%v_%v", lastTerm, lastIndex)
+}
+
+func (store *FileSnapshotStore) pathFor(id string) string {
+	return path.Join(store.dir, id+".ss")
+}
+
+func (store *FileSnapshotStore) Create(lastIndex uint64, lastTerm uint64, peers []string) (SnapshotSink, error) {
+	id := store.idFor(lastIndex, lastTerm)
+	return &fileSnapshotSink{
+		store:     store,
+		id:        id,
+		lastIndex: lastIndex,
+		lastTerm:  lastTerm,
+		peers:     peers,
+	}, nil
+}
+
+func (store *FileSnapshotStore) List() ([]*SnapshotMeta, error) {
+	entries, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".ss") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	metas := make([]*SnapshotMeta, 0, len(names))
+	for _, name := range names {
+		id := strings.TrimSuffix(name, ".ss")
+
+		var lastTerm, lastIndex uint64
+		if _, err := fmt.Sscanf(id, "%d_%d", &lastTerm, &lastIndex); err != nil {
+			continue
+		}
+		metas = append(metas, &SnapshotMeta{ID: id, LastIndex: lastIndex, LastTerm: lastTerm})
+	}
+
+	// Newest first by (LastTerm, LastIndex), not by filename: lexical order
+	// puts "9_9.ss" after "10_100.ss" once an index or term crosses a digit
+	// boundary, which would make Reap delete the actual newest snapshot and
+	// LoadSnapshot try an actual older one first.
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].LastTerm != metas[j].LastTerm {
+			return metas[i].LastTerm > metas[j].LastTerm
+		}
+		return metas[i].LastIndex > metas[j].LastIndex
+	})
+	return metas, nil
+}
+
+// Open reads and validates the snapshot with the given ID. A snapshot that
+// can't be read back - missing checksum header, checksum mismatch, or an
+// undecodable body - is quarantined (renamed to ".broken") rather than left
+// to be retried, so LoadSnapshot's next attempt moves on to an older one.
+func (store *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	snapshotPath := store.pathFor(id)
+
+	snapshot, err := readSnapshotFile(snapshotPath)
+	if err != nil {
+		os.Rename(snapshotPath, snapshotPath+".broken")
+		return nil, nil, err
+	}
+
+	meta := &SnapshotMeta{ID: id, LastIndex: snapshot.LastIndex, LastTerm: snapshot.LastTerm, Peers: snapshot.Peers}
+	return meta, ioutil.NopCloser(bytes.NewReader(snapshot.State)), nil
+}
+
+// Reap deletes all but the newest retain snapshots. A single file failing
+// to remove doesn't stop the rest from being reaped; it's reported once all
+// of them have been attempted.
+func (store *FileSnapshotStore) Reap() error {
+	metas, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	retain := store.retain
+	store.mutex.Unlock()
+
+	if len(metas) <= retain {
+		return nil
+	}
+
+	var lastErr error
+	for _, meta := range metas[retain:] {
+		if err := os.Remove(store.pathFor(meta.ID)); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// setRetain lets Server.SetSnapshotRetain keep a FileSnapshotStore's own
+// retention count in sync with the server-level setting.
+func (store *FileSnapshotStore) setRetain(n int) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.retain = n
+}
+
+// fileSnapshotSink buffers a snapshot's state in memory and only performs
+// the atomic write (via writeSnapshotFile) on Close, so a cancelled or
+// failed transfer never leaves a partial file in the snapshot directory.
+type fileSnapshotSink struct {
+	store     *FileSnapshotStore
+	id        string
+	lastIndex uint64
+	lastTerm  uint64
+	peers     []string
+	buf       bytes.Buffer
+}
+
+func (sink *fileSnapshotSink) Write(p []byte) (int, error) {
+	return sink.buf.Write(p)
+}
+
+func (sink *fileSnapshotSink) ID() string {
+	return sink.id
+}
+
+func (sink *fileSnapshotSink) Close() error {
+	snapshot := &Snapshot{
+		LastIndex: sink.lastIndex,
+		LastTerm:  sink.lastTerm,
+		Peers:     sink.peers,
+		State:     sink.buf.Bytes(),
+		Path:      sink.store.pathFor(sink.id),
+	}
+	return writeSnapshotFile(snapshot)
+}
+
+func (sink *fileSnapshotSink) Cancel() error {
+	sink.buf.Reset()
+	return nil
+}
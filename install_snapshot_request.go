@@ -0,0 +1,34 @@
+package raft
+
+// The request sent to a follower to install a snapshot, in place of log
+// entries the leader no longer has because they were compacted away. The
+// snapshot file is sent in fixed-size chunks so that no single RPC carries
+// the whole blob; both ends still read the whole file into memory (the
+// leader before sending, the follower when finalizing). Chunks belonging to
+// the same transfer share LastIndex/LastTerm and are ordered by Offset.
+type InstallSnapshotRequest struct {
+	Header     `json:"header"`
+	Term       uint64   `json:"term"`
+	LeaderName string   `json:"leaderName"`
+	LastIndex  uint64   `json:"lastIndex"`
+	LastTerm   uint64   `json:"lastTerm"`
+	PeerNames  []string `json:"peerNames"`
+	Offset     uint64   `json:"offset"`
+	Data       []byte   `json:"data"`
+	Done       bool     `json:"done"`
+}
+
+// Creates a new InstallSnapshot request.
+func newInstallSnapshotRequest(term uint64, leaderName string, lastIndex uint64, lastTerm uint64, peerNames []string, offset uint64, data []byte, done bool) *InstallSnapshotRequest {
+	return &InstallSnapshotRequest{
+		Header:     newHeader(),
+		Term:       term,
+		LeaderName: leaderName,
+		LastIndex:  lastIndex,
+		LastTerm:   lastTerm,
+		PeerNames:  peerNames,
+		Offset:     offset,
+		Data:       data,
+		Done:       done,
+	}
+}
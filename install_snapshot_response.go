@@ -0,0 +1,23 @@
+package raft
+
+// The response to an InstallSnapshotRequest. BytesWritten reports the offset
+// in the transfer up to which the follower has written: the end of the
+// chunk on success, the chunk's starting offset on failure. The leader does
+// not read it; installSnapshotToPeer aborts the transfer on the first
+// rejected chunk.
+type InstallSnapshotResponse struct {
+	Header       `json:"header"`
+	Term         uint64 `json:"term"`
+	Success      bool   `json:"success"`
+	BytesWritten uint64 `json:"bytesWritten"`
+}
+
+// Creates a new InstallSnapshot response.
+func newInstallSnapshotResponse(term uint64, success bool, bytesWritten uint64) *InstallSnapshotResponse {
+	return &InstallSnapshotResponse{
+		Header:       newHeader(),
+		Term:         term,
+		Success:      success,
+		BytesWritten: bytesWritten,
+	}
+}
@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned by Do/DoContext while a TransferLeadership call is outstanding,
+// so callers don't append new entries the outgoing leader may never get the
+// chance to replicate.
+var LeadershipTransferInProgressError = errors.New("raft: Leadership transfer in progress")
+
+// Sent by the current leader to the peer it's handing leadership to. It
+// tells the follower to start an election immediately rather than waiting
+// out its normal randomized election timeout.
+type TimeoutNowRequest struct {
+	Header     `json:"header"`
+	Term       uint64 `json:"term"`
+	LeaderName string `json:"leaderName"`
+}
+
+// Creates a new TimeoutNow request.
+func newTimeoutNowRequest(term uint64, leaderName string) *TimeoutNowRequest {
+	return &TimeoutNowRequest{Header: newHeader(), Term: term, LeaderName: leaderName}
+}
+
+// The response to a TimeoutNowRequest.
+type TimeoutNowResponse struct {
+	Header  `json:"header"`
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+// Creates a new TimeoutNow response.
+func newTimeoutNowResponse(term uint64, success bool) *TimeoutNowResponse {
+	return &TimeoutNowResponse{Header: newHeader(), Term: term, Success: success}
+}
+
+// TransferLeadership asks target to take over leadership, so an operator
+// can move a leader off a node before shutdown or maintenance without
+// paying the usual election-timeout gap in availability. It returns nil as
+// soon as target accepts the TimeoutNowRequest and becomes a Candidate; it
+// does not wait for target to win the election. While the
+// transfer is outstanding, new calls to Do/DoContext return
+// LeadershipTransferInProgressError. Once target's log has caught up to
+// ours, we send it a TimeoutNowRequest so it starts an election right away;
+// if it doesn't catch up within one election timeout, the transfer is
+// aborted and this server resumes normal operation as leader.
+func (s *Server) TransferLeadership(target string) error {
+	if s.State() != Leader {
+		return NotLeaderError
+	}
+
+	s.mutex.Lock()
+	peer, ok := s.peers[target]
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("raft: Unknown transfer target: %s", target)
+	}
+	s.transferTarget = target
+	s.mutex.Unlock()
+	defer s.clearTransferTarget()
+
+	deadline := time.Now().Add(s.ElectionTimeout())
+	ticker := time.NewTicker(s.heartbeatTimeout)
+	defer ticker.Stop()
+
+	for {
+		if s.State() != Leader {
+			return NotLeaderError
+		}
+
+		if peer.getPrevLogIndex() >= s.log.currentIndex() {
+			resp, err := s.transporter.SendTimeoutNowRequest(s, peer, newTimeoutNowRequest(s.currentTerm, s.name))
+			if err != nil {
+				return fmt.Errorf("raft: Unable to send TimeoutNow to %s: %s", target, err)
+			}
+			if !resp.Success {
+				return fmt.Errorf("raft: %s rejected TimeoutNow", target)
+			}
+			s.setPeerProtocolVersion(target, resp.ProtocolVersion)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("raft: Leadership transfer to %s timed out waiting for it to catch up", target)
+		}
+
+		<-ticker.C
+	}
+}
+
+// Clears any in-progress transfer, letting Do/DoContext accept commands
+// again.
+func (s *Server) clearTransferTarget() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transferTarget = ""
+}
+
+// Requests that a follower time out its election timer immediately and
+// start a new election. Used by the leader during a graceful leadership
+// transfer.
+func (s *Server) TimeoutNow(req *TimeoutNowRequest) *TimeoutNowResponse {
+	ret, _ := s.send(req)
+	resp, _ := ret.(*TimeoutNowResponse)
+	return resp
+}
+
+// Processes a TimeoutNowRequest: skips the remainder of this server's
+// election timeout and transitions straight to Candidate.
+func (s *Server) processTimeoutNowRequest(req *TimeoutNowRequest) *TimeoutNowResponse {
+	if err := checkRPCHeader(req.Header); err != nil {
+		return newTimeoutNowResponse(s.currentTerm, false)
+	}
+
+	if req.Term < s.currentTerm {
+		return newTimeoutNowResponse(s.currentTerm, false)
+	}
+
+	s.debugln("server.timeoutnow: starting election immediately at request of ", req.LeaderName)
+	s.setState(Candidate)
+	return newTimeoutNowResponse(s.currentTerm, true)
+}
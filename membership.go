@@ -0,0 +1,264 @@
+package raft
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+func init() {
+	// Lets the log decode ChangeMembershipCommand entries read back from
+	// disk on restart (see NewServer's ApplyFunc) instead of failing to
+	// replay them.
+	RegisterCommand(&ChangeMembershipCommand{})
+}
+
+// The cluster's membership configuration. While `old` is non-empty the
+// cluster is in the joint-consensus period described in the Raft paper's
+// §6: both `old` and `new` must independently reach a majority before an
+// entry (or an election) counts as committed/won. Once the joint entry
+// commits, the leader appends a second ChangeMembershipCommand with `new`
+// only, which collapses `old` back to nil and returns to single-majority
+// quorum.
+type configuration struct {
+	old []string
+	new []string
+}
+
+// Whether the cluster is currently transitioning between configurations.
+func (c *configuration) joint() bool {
+	return c != nil && len(c.old) > 0
+}
+
+// The configuration(s) a quorum must currently be computed against.
+func (c *configuration) sets() [][]string {
+	if c == nil {
+		return nil
+	}
+	if c.joint() {
+		return [][]string{c.old, c.new}
+	}
+	return [][]string{c.new}
+}
+
+// ChangeMembershipCommand carries both the old and new cluster
+// configurations for a two-phase membership change. The safety property
+// comes from how quorum is computed while the entry is in flight (see
+// QuorumSize and processAppendEntriesResponse); noteConfigurationChange
+// records Old/New the moment the entry is appended - on the leader in
+// processCommand, on a follower in processAppendEntriesRequest - so that
+// window actually constrains quorum. Apply only re-records it (needed so a
+// restart replaying the log from disk picks it up too) and reconciles the
+// live peer set.
+type ChangeMembershipCommand struct {
+	Old []string `json:"old"`
+	New []string `json:"new"`
+}
+
+// The name of the command in the log.
+func (c *ChangeMembershipCommand) CommandName() string {
+	return "raft:changeMembership"
+}
+
+// Applies the configuration change: converges the live peer set to New and
+// records Old/New on the server so quorum calculations honor the
+// joint-consensus window until the transition completes. This is also what
+// puts the configuration back in place when a restart replays the command
+// from the on-disk log; at runtime it's redundant with
+// noteConfigurationChange, which already recorded it when the entry was
+// appended.
+func (c *ChangeMembershipCommand) Apply(server *Server) (interface{}, error) {
+	server.noteConfigurationChange(c)
+	server.applyPeerSet(c.New)
+
+	return nil, nil
+}
+
+// Records Old/New from a ChangeMembershipCommand on the server the instant
+// its entry is appended to the log - before it's committed, let alone
+// applied - so the joint-consensus safety window described in the Raft
+// paper's §6 constrains quorum for the entirety of the time the entry is in
+// flight. Called for every Command appended, and is a no-op for anything
+// that isn't a membership change.
+//
+// It also starts replicating to (and soliciting votes from) any peer that
+// only exists in New, right away rather than waiting for the entry to
+// commit. Otherwise a change whose New majority depends on the arriving
+// peers - growing a 1-node cluster to 3, say - could never collect that
+// majority, since the peers scoring it would not exist yet: the joint
+// entry would never commit, and so never apply, and so never add them.
+// Peers that are leaving (present in Old but not New) are left alone here;
+// applyPeerSet removes them once the change actually commits, since their
+// votes/acks are still needed for the Old majority until then.
+func (s *Server) noteConfigurationChange(cmd Command) {
+	c, ok := cmd.(*ChangeMembershipCommand)
+	if !ok {
+		return
+	}
+
+	s.ensurePeers(c.New)
+
+	s.mutex.Lock()
+	s.configuration = &configuration{old: c.Old, new: c.New}
+	s.mutex.Unlock()
+}
+
+// Decodes entry as a ChangeMembershipCommand if that's what it is, so a
+// follower can apply noteConfigurationChange to entries it appends without
+// waiting for them to commit. Returns ok == false for any other command.
+func decodeChangeMembershipCommand(entry *LogEntry) (cmd *ChangeMembershipCommand, ok bool) {
+	if entry.CommandName() != (&ChangeMembershipCommand{}).CommandName() {
+		return nil, false
+	}
+
+	cmd = &ChangeMembershipCommand{}
+	if err := json.Unmarshal(entry.Command(), cmd); err != nil {
+		return nil, false
+	}
+	return cmd, true
+}
+
+// Adds a Peer for any name in names not already present (and not this
+// server), leaving the rest of the live peer set untouched.
+func (s *Server) ensurePeers(names []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, name := range names {
+		if name == s.name || s.peers[name] != nil {
+			continue
+		}
+		peer := newPeer(s, name, s.heartbeatTimeout)
+		if s.state == Leader {
+			peer.startHeartbeat()
+		}
+		s.peers[name] = peer
+	}
+}
+
+// Reconciles the live peers map with the target configuration, adding any
+// peer not yet present and removing any peer no longer in it.
+func (s *Server) applyPeerSet(names []string) {
+	s.ensurePeers(names)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	for name, peer := range s.peers {
+		if !wanted[name] {
+			peer.stopHeartbeat()
+			delete(s.peers, name)
+		}
+	}
+}
+
+// Replaces the cluster's membership with the given set of peer names
+// (including this server). On a leader this drives the two-phase
+// joint-consensus change: a first log entry carrying both the current and
+// target configurations, which is only committed once it has a majority in
+// both, followed by a second entry carrying just the target configuration
+// that ends the transition. AddPeer/RemovePeer are thin wrappers around
+// this for the common single-server case.
+func (s *Server) SetConfiguration(peers []string) error {
+	if s.State() != Leader {
+		return NotLeaderError
+	}
+
+	s.mutex.RLock()
+	oldPeers := make([]string, 0, len(s.peers)+1)
+	for name := range s.peers {
+		oldPeers = append(oldPeers, name)
+	}
+	oldPeers = append(oldPeers, s.name)
+	s.mutex.RUnlock()
+
+	if _, err := s.Do(&ChangeMembershipCommand{Old: oldPeers, New: peers}); err != nil {
+		return err
+	}
+
+	if _, err := s.Do(&ChangeMembershipCommand{Old: nil, New: peers}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Because ChangeMembershipCommand.Apply runs through the same ApplyFunc the
+// log uses to replay committed entries on open (see NewServer), and the
+// command type is registered with RegisterCommand above so the log can
+// decode it back out of what it persisted, membership changes are
+// automatically replayed at startup with no separate recovery path needed.
+
+//--------------------------------------
+// Quorum
+//--------------------------------------
+
+// Computes the highest index a majority of the given names has reached.
+// indexOf is expected to return the leader's own last log index for its own
+// name.
+func quorumIndex(names []string, indexOf func(name string) uint64) uint64 {
+	if len(names) == 0 {
+		return 0
+	}
+	indices := make([]uint64, 0, len(names))
+	for _, name := range names {
+		indices = append(indices, indexOf(name))
+	}
+	sort.Sort(uint64Slice(indices))
+	quorum := (len(names) / 2) + 1
+	return indices[quorum-1]
+}
+
+// Computes the index that can be committed given the current configuration.
+// While a joint-consensus change is in flight, this is the minimum of the
+// index a majority of the old configuration has reached and the index a
+// majority of the new configuration has reached, so committing an entry
+// requires agreement from both the departing and arriving member sets.
+func (s *Server) quorumCommitIndex(indexOf func(name string) uint64) uint64 {
+	sets := s.configuration.sets()
+	if len(sets) == 0 {
+		// No configuration change has ever been made; fall back to the
+		// single current membership.
+		names := make([]string, 0, len(s.peers)+1)
+		names = append(names, s.name)
+		for name := range s.peers {
+			names = append(names, name)
+		}
+		return quorumIndex(names, indexOf)
+	}
+
+	result := quorumIndex(sets[0], indexOf)
+	for _, set := range sets[1:] {
+		if idx := quorumIndex(set, indexOf); idx < result {
+			result = idx
+		}
+	}
+	return result
+}
+
+// Reports whether the names in granted form a quorum under the current
+// configuration - a majority of both the old and new sets while a
+// membership change is in flight, otherwise a simple majority.
+func (s *Server) hasQuorum(granted map[string]bool) bool {
+	sets := s.configuration.sets()
+	if len(sets) == 0 {
+		return len(granted) >= s.QuorumSize()
+	}
+
+	for _, set := range sets {
+		count := 0
+		for _, name := range set {
+			if granted[name] {
+				count++
+			}
+		}
+		if count < (len(set)/2)+1 {
+			return false
+		}
+	}
+	return true
+}
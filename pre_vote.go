@@ -0,0 +1,103 @@
+package raft
+
+import "time"
+
+// Sends a pre-vote request to a peer and delivers the response on respChan.
+// Mirrors peer.sendVoteRequest, but pre-votes never mutate the recipient's
+// term or votedFor, so they're safe to send speculatively.
+func (peer *Peer) sendPreVoteRequest(req *PreVoteRequest, c chan *PreVoteResponse) {
+	resp, err := peer.server.Transporter().SendPreVoteRequest(peer.server, peer, req)
+	if err != nil {
+		peer.server.debugln("raft.peer.prevote: ", err)
+		return
+	}
+	c <- resp
+}
+
+// The outcome of a pre-vote phase, delivered back to the follower event
+// loop through the same s.c channel as any other event so the phase can
+// run without blocking RPC handling. epoch ties the result back to the
+// round that produced it, so a result that arrives after the follower
+// already heard from a live leader (and started a new round, or gave up
+// waiting) is recognized as stale and ignored.
+type preVoteResult struct {
+	epoch   int
+	granted bool
+}
+
+// Runs the pre-vote phase described in Ongaro's thesis §4.2.3: before
+// incrementing currentTerm and becoming a Candidate, ask every peer whether
+// it would actually vote for us at currentTerm+1. Peers grant a pre-vote
+// without touching their own term or votedFor, so a server that has been
+// partitioned away and incrementing its term in a loop can no longer force
+// a healthy cluster's leader to step down the moment it rejoins. Returns
+// true once a quorum of pre-votes has been granted.
+func (s *Server) runPreVotePhase() bool {
+	lastLogIndex, lastLogTerm := s.log.lastInfo()
+	term := s.currentTerm + 1
+
+	respChan := make(chan *PreVoteResponse, len(s.peers))
+	for _, peer := range s.peers {
+		go peer.sendPreVoteRequest(newPreVoteRequest(term, s.name, lastLogIndex, lastLogTerm), respChan)
+	}
+
+	votesGranted := 1
+	quorum := s.QuorumSize()
+	timeoutChan := afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
+
+	for votesGranted < quorum {
+		select {
+		case resp := <-respChan:
+			if resp.VoteGranted {
+				votesGranted++
+			}
+		case <-timeoutChan:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Starts a pre-vote phase on its own goroutine and posts the result back to
+// the follower event loop via sendAsync, instead of blocking the loop on
+// peer responses. This keeps followerLoop free to keep servicing
+// AppendEntries and RequestVote RPCs - including from a live leader - for
+// the up-to-2x-election-timeout duration a pre-vote round can take.
+func (s *Server) beginPreVotePhase(epoch int) {
+	go func() {
+		s.sendAsync(&preVoteResult{epoch: epoch, granted: s.runPreVotePhase()})
+	}()
+}
+
+// Processes a "pre-vote" request. A pre-vote is granted under the same log
+// up-to-date-ness rule as a real vote, and additionally only if the server
+// has not heard from a valid leader recently - but granting one never
+// updates currentTerm or votedFor.
+func (s *Server) processPreVoteRequest(req *PreVoteRequest) (*PreVoteResponse, bool) {
+	if err := checkRPCHeader(req.Header); err != nil {
+		return newPreVoteResponse(s.currentTerm, false), false
+	}
+
+	// Don't grant a pre-vote if we believe a leader is still around: we are
+	// one ourselves, or we're a follower that's heard from one within the
+	// last election timeout. s.leader isn't a usable signal for this -
+	// unlike lastHeartbeat, it's never cleared just because the leader
+	// stopped sending heartbeats, only when we see a higher term or
+	// ourselves become a Candidate - so using it here would mean no follower could ever grant
+	// a pre-vote after a real leader crashes.
+	if s.state == Leader || (s.state == Follower && time.Since(s.lastHeartbeat()) < s.ElectionTimeout()) {
+		return newPreVoteResponse(s.currentTerm, false), false
+	}
+
+	if req.Term < s.currentTerm {
+		return newPreVoteResponse(s.currentTerm, false), false
+	}
+
+	lastIndex, lastTerm := s.log.lastInfo()
+	if lastIndex > req.LastLogIndex || lastTerm > req.LastLogTerm {
+		return newPreVoteResponse(s.currentTerm, false), false
+	}
+
+	return newPreVoteResponse(s.currentTerm, true), false
+}
@@ -0,0 +1,24 @@
+package raft
+
+// A PreVoteRequest carries the same information as a RequestVoteRequest but
+// is tagged separately so peers know granting it must not perturb their
+// term or votedFor. It lets a server check whether it could actually win an
+// election before paying the cost of starting one.
+type PreVoteRequest struct {
+	Header        `json:"header"`
+	Term          uint64 `json:"term"`
+	CandidateName string `json:"candidateName"`
+	LastLogIndex  uint64 `json:"lastLogIndex"`
+	LastLogTerm   uint64 `json:"lastLogTerm"`
+}
+
+// Creates a new PreVote request.
+func newPreVoteRequest(term uint64, candidateName string, lastLogIndex uint64, lastLogTerm uint64) *PreVoteRequest {
+	return &PreVoteRequest{
+		Header:        newHeader(),
+		Term:          term,
+		CandidateName: candidateName,
+		LastLogIndex:  lastLogIndex,
+		LastLogTerm:   lastLogTerm,
+	}
+}
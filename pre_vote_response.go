@@ -0,0 +1,17 @@
+package raft
+
+// The response to a PreVoteRequest.
+type PreVoteResponse struct {
+	Header      `json:"header"`
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+// Creates a new PreVote response.
+func newPreVoteResponse(term uint64, voteGranted bool) *PreVoteResponse {
+	return &PreVoteResponse{
+		Header:      newHeader(),
+		Term:        term,
+		VoteGranted: voteGranted,
+	}
+}
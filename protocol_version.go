@@ -0,0 +1,54 @@
+package raft
+
+import "errors"
+
+// Header is embedded in every RPC request and response (AppendEntries,
+// RequestVote, InstallSnapshot, and their responses) so that a cluster can
+// be upgraded node-by-node instead of requiring every node to move in
+// lockstep. Modeled on hashicorp/raft's RPCHeader.
+type Header struct {
+	ProtocolVersion uint8 `json:"protocolVersion"`
+}
+
+// The range of protocol versions this build of the server understands.
+// ProtocolVersionMax is what this build sends; ProtocolVersionMin is the
+// oldest version it will still accept from a peer running older code.
+const (
+	ProtocolVersionMin uint8 = 1
+	ProtocolVersionMax uint8 = 1
+)
+
+// ErrUnsupportedProtocol is returned when an incoming RPC's ProtocolVersion
+// falls outside [ProtocolVersionMin, ProtocolVersionMax].
+var ErrUnsupportedProtocol = errors.New("raft: Unsupported protocol version")
+
+// Builds the header to stamp on outgoing RPCs.
+func newHeader() Header {
+	return Header{ProtocolVersion: ProtocolVersionMax}
+}
+
+// Validates an incoming RPC's protocol version, invoked at the top of
+// processAppendEntriesRequest and processRequestVoteRequest (and the newer
+// InstallSnapshot/PreVote/TimeoutNow handlers) before anything else about
+// the request is trusted.
+func checkRPCHeader(h Header) error {
+	if h.ProtocolVersion < ProtocolVersionMin || h.ProtocolVersion > ProtocolVersionMax {
+		return ErrUnsupportedProtocol
+	}
+	return nil
+}
+
+// Records the protocol version a peer was last observed to speak, taken
+// from the Header of its InstallSnapshot and TimeoutNow responses;
+// AppendEntries and RequestVote responses are not recorded. Nothing reads
+// the recorded value back: with ProtocolVersionMin == ProtocolVersionMax == 1
+// there is only one encoding, and outgoing RPCs are always stamped with
+// ProtocolVersionMax.
+func (s *Server) setPeerProtocolVersion(name string, version uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.peerProtocolVersions == nil {
+		s.peerProtocolVersions = make(map[string]uint8)
+	}
+	s.peerProtocolVersions[name] = version
+}
@@ -1,14 +1,12 @@
 package raft
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"path"
-	"sort"
 	"sync"
 	"time"
 )
@@ -31,6 +29,10 @@ const (
 	DefaultElectionTimeout  = 150 * time.Millisecond
 )
 
+// DefaultSnapshotRetain is how many of the newest snapshot files reapSnapshots
+// keeps on disk, unless overridden with SetSnapshotRetain.
+const DefaultSnapshotRetain = 5
+
 var stopValue interface{}
 
 //------------------------------------------------------------------------------
@@ -73,6 +75,38 @@ type Server struct {
 	currentSnapshot *Snapshot
 	lastSnapshot    *Snapshot
 	stateMachine    StateMachine
+
+	configuration *configuration
+
+	transferTarget string
+
+	peerProtocolVersions map[string]uint8
+
+	commandTimeout time.Duration
+
+	preVoteEnabled bool
+
+	eventListeners  map[string][]EventListener
+	eventMutex      sync.RWMutex
+	eventc          chan Event
+	lastHeartbeatAt time.Time
+
+	snapshotRetain             int
+	streamingSnapshotThreshold int64
+
+	snapshotThreshold int
+	appliedSinceSnap  int
+	snapshotTriggerc  chan struct{}
+	snapshotApplyc    chan *snapshotApply
+
+	snapshotStallTimeout  time.Duration
+	snapshotStatsMutex    sync.Mutex
+	snapshotBytesInFlight uint64
+	snapshotLastProgress  time.Time
+	snapshotAttemptsTotal uint64
+	snapshotFailuresTotal uint64
+
+	snapshotStore SnapshotStore
 }
 
 // An event to be processed by the server's event loop.
@@ -90,6 +124,15 @@ type event struct {
 
 // Creates a new server with a log at the given path.
 func NewServer(name string, path string, transporter Transporter, stateMachine StateMachine, context interface{}) (*Server, error) {
+	return NewServerWithSnapshotStore(name, path, transporter, stateMachine, context, nil)
+}
+
+// Like NewServer, but lets the caller choose what persists and retrieves
+// the server's snapshots. Passing nil gives the same on-disk behavior
+// NewServer has always had, a FileSnapshotStore rooted at "<path>/snapshot";
+// an in-memory store can be injected for tests, or an object-storage-backed
+// one for cloud deployments, without forking this package.
+func NewServerWithSnapshotStore(name string, path string, transporter Transporter, stateMachine StateMachine, context interface{}, store SnapshotStore) (*Server, error) {
 	if name == "" {
 		return nil, errors.New("raft.Server: Name cannot be blank")
 	}
@@ -97,6 +140,14 @@ func NewServer(name string, path string, transporter Transporter, stateMachine S
 		panic("raft: Transporter required")
 	}
 
+	if store == nil {
+		fileStore, err := NewFileSnapshotStore(path+"/snapshot", DefaultSnapshotRetain)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+
 	s := &Server{
 		name:             name,
 		path:             path,
@@ -107,13 +158,33 @@ func NewServer(name string, path string, transporter Transporter, stateMachine S
 		peers:            make(map[string]*Peer),
 		log:              newLog(),
 		c:                make(chan *event, 256),
+		eventc:           make(chan Event, DefaultEventQueueSize),
 		electionTimeout:  DefaultElectionTimeout,
 		heartbeatTimeout: DefaultHeartbeatTimeout,
+		commandTimeout:   DefaultCommandTimeout,
+		preVoteEnabled:   true,
+		snapshotRetain:   DefaultSnapshotRetain,
+		snapshotStore:    store,
+
+		streamingSnapshotThreshold: DefaultStreamingSnapshotThreshold,
+
+		snapshotThreshold: DefaultSnapshotThreshold,
+		snapshotTriggerc:  make(chan struct{}, 1),
+		snapshotApplyc:    make(chan *snapshotApply),
+
+		snapshotStallTimeout: DefaultSnapshotStallTimeout,
 	}
 
 	// Setup apply function.
 	s.log.ApplyFunc = func(c Command) (interface{}, error) {
 		result, err := c.Apply(s)
+
+		s.appliedSinceSnap++
+		if s.appliedSinceSnap >= s.SnapshotThreshold() {
+			s.appliedSinceSnap = 0
+			s.TriggerSnapshot()
+		}
+
 		return result, err
 	}
 
@@ -190,11 +261,16 @@ func (s *Server) State() string {
 // Sets the state of the server.
 func (s *Server) setState(state string) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	prevState := s.state
 	s.state = state
 	if state == Leader {
 		s.leader = s.Name()
 	}
+	s.mutex.Unlock()
+
+	if state != prevState {
+		s.dispatchEvent(Event{Type: StateChangeEventType, Value: state, PrevValue: prevState})
+	}
 }
 
 // Retrieves the current term of the server.
@@ -245,7 +321,10 @@ func (s *Server) MemberCount() int {
 	return len(s.peers) + 1
 }
 
-// Retrieves the number of servers required to make a quorum.
+// Retrieves the number of servers required to make a quorum. This reflects
+// the current, single-configuration membership; while a joint-consensus
+// change is in flight, use hasQuorum/quorumCommitIndex instead, which honor
+// the old and new configurations independently.
 func (s *Server) QuorumSize() int {
 	return (s.MemberCount() / 2) + 1
 }
@@ -284,6 +363,22 @@ func (s *Server) SetHeartbeatTimeout(duration time.Duration) {
 	}
 }
 
+//--------------------------------------
+// Pre-Vote
+//--------------------------------------
+
+// Retrieves whether the pre-vote phase is enabled.
+func (s *Server) PreVoteEnabled() bool {
+	return s.preVoteEnabled
+}
+
+// Enables or disables the pre-vote phase. Disabling it restores the old
+// behavior of transitioning straight to Candidate on election timeout, kept
+// around for clusters that need to roll back.
+func (s *Server) SetPreVoteEnabled(enabled bool) {
+	s.preVoteEnabled = enabled
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
@@ -305,6 +400,9 @@ func (s *Server) Initialize() error {
 	// Create snapshot directory if not exist
 	os.Mkdir(s.path+"/snapshot", 0700)
 
+	go s.snapshotter()
+	go s.eventDispatchLoop()
+
 	// Initialize the log and load it up.
 	if err := s.log.open(s.LogPath()); err != nil {
 		s.debugln("raft: Log error: %s", err)
@@ -428,12 +526,17 @@ func (s *Server) sendAsync(value interface{}) *event {
 // The event loop that is run when the server is in a Follower state.
 // Responds to RPCs from candidates and leaders.
 // Converts to candidate if election timeout elapses without either:
-//   1.Receiving valid AppendEntries RPC, or
-//   2.Granting vote to candidate
+//
+//	1.Receiving valid AppendEntries RPC, or
+//	2.Granting vote to candidate
 func (s *Server) followerLoop() {
 
 	s.setState(Follower)
+	s.setLastHeartbeat(time.Now())
+	go s.electionTimeoutThresholdWatchdog()
 	timeoutChan := afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
+	preVoteInFlight := false
+	preVoteEpoch := 0
 
 	for {
 		var err error
@@ -448,20 +551,63 @@ func (s *Server) followerLoop() {
 				e.returnValue, update = s.processAppendEntriesRequest(req)
 			} else if req, ok := e.target.(*RequestVoteRequest); ok {
 				e.returnValue, update = s.processRequestVoteRequest(req)
+			} else if req, ok := e.target.(*InstallSnapshotRequest); ok {
+				e.returnValue, update = s.processInstallSnapshotRequest(req)
+			} else if req, ok := e.target.(*SnapshotChunkRequest); ok {
+				e.returnValue, update = s.processSnapshotChunkRequest(req)
+			} else if req, ok := e.target.(*PreVoteRequest); ok {
+				e.returnValue, _ = s.processPreVoteRequest(req)
+			} else if req, ok := e.target.(*TimeoutNowRequest); ok {
+				e.returnValue = s.processTimeoutNowRequest(req)
+			} else if result, ok := e.target.(*preVoteResult); ok {
+				if result.epoch == preVoteEpoch && preVoteInFlight {
+					preVoteInFlight = false
+					if result.granted {
+						s.setState(Candidate)
+					} else {
+						// Pre-vote failed to reach quorum; stay a follower
+						// and wait out another election timeout instead
+						// of bumping our term for nothing.
+						timeoutChan = afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
+					}
+				}
+				// Otherwise this round was superseded by a heartbeat that
+				// arrived while it was in flight; drop it.
 			}
 
 			// Callback to event.
 			e.c <- err
 
 		case <-timeoutChan:
-			s.setState(Candidate)
+			s.dispatchEvent(Event{Type: ElectionTimeoutEventType, Value: s.ElectionTimeout()})
+			if !s.preVoteEnabled {
+				s.setState(Candidate)
+			} else if !preVoteInFlight {
+				// Run the pre-vote round off this loop so AppendEntries
+				// and RequestVote RPCs - including from a leader that's
+				// still alive - keep being serviced while it's in flight.
+				// timeoutChan stays parked (nil) until the result comes
+				// back on s.c, so we don't start overlapping rounds.
+				preVoteInFlight = true
+				preVoteEpoch++
+				timeoutChan = nil
+				s.beginPreVotePhase(preVoteEpoch)
+			}
+		}
+
+		if update && preVoteInFlight {
+			// A valid AppendEntries/RequestVote arrived while a pre-vote
+			// round was outstanding; we're no longer a candidate for that
+			// round; let its result, whenever it arrives, be ignored.
+			preVoteInFlight = false
+			preVoteEpoch++
 		}
 
 		// Converts to candidate if election timeout elapses without either:
 		//   1.Receiving valid AppendEntries RPC, or
 		//   2.Granting vote to candidate
 		if update {
-    		timeoutChan = afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
+			timeoutChan = afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
 		}
 
 		// Exit loop on state change.
@@ -471,6 +617,14 @@ func (s *Server) followerLoop() {
 	}
 }
 
+// A RequestVoteResponse tagged with the name of the peer it came from, so
+// the candidate can check quorum per-configuration during a joint-consensus
+// membership change instead of just counting votes.
+type voteResult struct {
+	name string
+	resp *RequestVoteResponse
+}
+
 // The event loop that is run when the server is in a Candidate state.
 func (s *Server) candidateLoop() {
 	lastLogIndex, lastLogTerm := s.log.lastInfo()
@@ -481,10 +635,24 @@ func (s *Server) candidateLoop() {
 		s.currentTerm++
 		s.votedFor = s.name
 
-		// Send RequestVote RPCs to all other servers.
-		respChan := make(chan *RequestVoteResponse, len(s.peers))
+		// Send RequestVote RPCs to all other servers. Responses are tagged
+		// with the peer's name so that, during a joint-consensus
+		// membership change, we can tell whether a quorum has been reached
+		// in both the old and new configuration rather than just counting
+		// votes.
+		respChan := make(chan voteResult, len(s.peers))
 		for _, peer := range s.peers {
-			go peer.sendVoteRequest(newRequestVoteRequest(s.currentTerm, s.name, lastLogIndex, lastLogTerm), respChan)
+			go func(p *Peer) {
+				peerRespChan := make(chan *RequestVoteResponse, 1)
+				go p.sendVoteRequest(newRequestVoteRequest(s.currentTerm, s.name, lastLogIndex, lastLogTerm), peerRespChan)
+				select {
+				case resp := <-peerRespChan:
+					respChan <- voteResult{name: p.Name(), resp: resp}
+				case <-afterBetween(s.ElectionTimeout()*2, s.ElectionTimeout()*2):
+					// Peer never responded in time; the outer loop has its
+					// own timeout and will move on without it.
+				}
+			}(peer)
 		}
 
 		// Wait for either:
@@ -492,27 +660,27 @@ func (s *Server) candidateLoop() {
 		//   * AppendEntries RPC received from new leader: step down.
 		//   * Election timeout elapses without election resolution: increment term, start new election
 		//   * Discover higher term: step down (§5.1)
-		votesGranted := 1
+		granted := map[string]bool{s.name: true}
 		timeoutChan := afterBetween(s.ElectionTimeout(), s.ElectionTimeout()*2)
 		timeout := false
 
 		for {
 			// If we received enough votes then stop waiting for more votes.
-			s.debugln("server.candidate.votes: ", votesGranted, " quorum:", s.QuorumSize())
-			if votesGranted >= s.QuorumSize() {
+			s.debugln("server.candidate.votes: ", len(granted), " quorum:", s.QuorumSize())
+			if s.hasQuorum(granted) {
 				s.setState(Leader)
 				break
 			}
 
 			// Collect votes from peers.
 			select {
-			case resp := <-respChan:
-				if resp.VoteGranted {
-					s.debugln("server.candidate.vote.granted: ", votesGranted)
-					votesGranted++
-				} else if resp.Term > s.currentTerm {
+			case result := <-respChan:
+				if result.resp.VoteGranted {
+					s.debugln("server.candidate.vote.granted: ", result.name)
+					granted[result.name] = true
+				} else if result.resp.Term > s.currentTerm {
 					s.debugln("server.candidate.vote.failed")
-					s.setCurrentTerm(resp.Term, "", false)
+					s.setCurrentTerm(result.resp.Term, "", false)
 				}
 
 			case e := <-s.c:
@@ -526,6 +694,14 @@ func (s *Server) candidateLoop() {
 					e.returnValue, _ = s.processAppendEntriesRequest(req)
 				} else if req, ok := e.target.(*RequestVoteRequest); ok {
 					e.returnValue, _ = s.processRequestVoteRequest(req)
+				} else if req, ok := e.target.(*InstallSnapshotRequest); ok {
+					e.returnValue, _ = s.processInstallSnapshotRequest(req)
+				} else if req, ok := e.target.(*SnapshotChunkRequest); ok {
+					e.returnValue, _ = s.processSnapshotChunkRequest(req)
+				} else if req, ok := e.target.(*PreVoteRequest); ok {
+					e.returnValue, _ = s.processPreVoteRequest(req)
+				} else if req, ok := e.target.(*TimeoutNowRequest); ok {
+					e.returnValue = s.processTimeoutNowRequest(req)
 				}
 
 				// Callback to event.
@@ -604,16 +780,26 @@ func (s *Server) leaderLoop() {
 //--------------------------------------
 
 // Attempts to execute a command and replicate it. The function will return
-// when the command has been successfully committed or an error has occurred.
-
+// when the command has been successfully committed or an error has
+// occurred. This is a thin wrapper over DoContext using the default
+// (background) context and the configured command timeout.
 func (s *Server) Do(command Command) (interface{}, error) {
-	return s.send(command)
+	return s.DoContext(context.Background(), command)
 }
 
-// Processes a command.
+// Processes a command: appends it to the log and spawns a goroutine that
+// delivers the commit result on a channel once replication finishes, or
+// CommandTimeoutError if that takes longer than CommandTimeout. The channel
+// is handed back through e.returnValue so DoAsync can return it to the
+// caller without blocking.
 func (s *Server) processCommand(command Command, e *event) {
 	s.debugln("server.command.process")
 
+	if s.transferTarget != "" {
+		e.c <- LeadershipTransferInProgressError
+		return
+	}
+
 	// Create an entry for the command in the log.
 	entry := s.log.createEntry(s.currentTerm, command)
 	if err := s.log.appendEntry(entry); err != nil {
@@ -621,22 +807,27 @@ func (s *Server) processCommand(command Command, e *event) {
 		e.c <- err
 		return
 	}
+	s.noteConfigurationChange(command)
+
+	resultChan := make(chan CommandResult, 1)
 
 	// Issue a callback for the entry once it's committed.
 	go func() {
 		// Wait for the entry to be committed.
 		select {
 		case <-entry.commit:
-			var err error
 			s.debugln("server.command.commit")
-			e.returnValue, err = s.log.getEntryResult(entry, true)
-			e.c <- err
-		case <-time.After(time.Second):
+			value, err := s.log.getEntryResult(entry, true)
+			resultChan <- CommandResult{Value: value, Err: err}
+		case <-time.After(s.CommandTimeout()):
 			s.debugln("server.command.timeout")
-			e.c <- CommandTimeoutError
+			resultChan <- CommandResult{Err: CommandTimeoutError}
 		}
 	}()
 
+	e.returnValue = resultChan
+	e.c <- nil
+
 	// Issue an append entries response for the server.
 	s.sendAsync(newAppendEntriesResponse(s.currentTerm, true, s.log.CommitIndex()))
 }
@@ -654,6 +845,11 @@ func (s *Server) AppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse
 
 // Processes the "append entries" request.
 func (s *Server) processAppendEntriesRequest(req *AppendEntriesRequest) (*AppendEntriesResponse, bool) {
+	if err := checkRPCHeader(req.Header); err != nil {
+		s.debugln("server.ae.error: ", err)
+		return newAppendEntriesResponse(s.currentTerm, false, s.log.CommitIndex()), false
+	}
+
 	if req.Term < s.currentTerm {
 		s.debugln("server.ae.error: stale term")
 		return newAppendEntriesResponse(s.currentTerm, false, s.log.CommitIndex()), false
@@ -662,6 +858,9 @@ func (s *Server) processAppendEntriesRequest(req *AppendEntriesRequest) (*Append
 	// Update term and leader.
 	s.setCurrentTerm(req.Term, req.LeaderName, true)
 
+	s.setLastHeartbeat(time.Now())
+	s.dispatchEvent(Event{Type: HeartbeatEventType, Value: req.LeaderName})
+
 	// Reject if log doesn't contain a matching previous entry.
 	if err := s.log.truncate(req.PrevLogIndex, req.PrevLogTerm); err != nil {
 		s.debugln("server.ae.truncate.error: ", err)
@@ -674,6 +873,15 @@ func (s *Server) processAppendEntriesRequest(req *AppendEntriesRequest) (*Append
 		return newAppendEntriesResponse(s.currentTerm, false, s.log.CommitIndex()), true
 	}
 
+	// Record any membership change the moment it's appended, not once it
+	// commits, so the joint-consensus safety window covers the entries the
+	// leader is still waiting on a quorum for.
+	for _, entry := range req.Entries {
+		if cmd, ok := decodeChangeMembershipCommand(entry); ok {
+			s.noteConfigurationChange(cmd)
+		}
+	}
+
 	// Commit up to the commit index.
 	if err := s.log.setCommitIndex(req.CommitIndex); err != nil {
 		s.debugln("server.ae.commit.error: ", err)
@@ -704,24 +912,31 @@ func (s *Server) processAppendEntriesResponse(resp *AppendEntriesResponse) {
 		return
 	}
 
-	// Determine the committed index that a majority has.
-	var indices []uint64
-	indices = append(indices, s.log.currentIndex())
-	for _, peer := range s.peers {
-		indices = append(indices, peer.getPrevLogIndex())
+	// Determine the committed index that a majority has. While a
+	// joint-consensus membership change is in flight this honors quorum in
+	// both the old and the new configuration, not just the current one, so
+	// a partitioned leader can't commit an entry that only one of the two
+	// majorities agrees with.
+	currentIndex := s.log.currentIndex()
+	indexOf := func(name string) uint64 {
+		if name == s.name {
+			return currentIndex
+		}
+		if peer, ok := s.peers[name]; ok {
+			return peer.getPrevLogIndex()
+		}
+		return 0
 	}
-	sort.Sort(uint64Slice(indices))
-
-	// We can commit up to the index which the majority of the members have appended.
-	commitIndex := indices[s.QuorumSize()-1]
+	commitIndex := s.quorumCommitIndex(indexOf)
 	committedIndex := s.log.commitIndex
 
 	if commitIndex > committedIndex {
 		s.log.setCommitIndex(commitIndex)
 		s.debugln("commit index ", commitIndex)
+		s.dispatchEvent(Event{Type: CommitEventType, Value: commitIndex, PrevValue: committedIndex})
 		for i := committedIndex; i < commitIndex; i++ {
 			if entry := s.log.getEntry(i + 1); entry != nil {
-				// if the leader is a new one and the entry came from the 
+				// if the leader is a new one and the entry came from the
 				// old leader, the commit channel will be nil and no go routine
 				// is waiting from this channel
 				// if we try to send to it, the new leader will get stuck
@@ -752,6 +967,11 @@ func (s *Server) RequestVote(req *RequestVoteRequest) *RequestVoteResponse {
 
 // Processes a "request vote" request.
 func (s *Server) processRequestVoteRequest(req *RequestVoteRequest) (*RequestVoteResponse, bool) {
+	if err := checkRPCHeader(req.Header); err != nil {
+		s.debugln("server.rv.error: ", err)
+		return newRequestVoteResponse(s.currentTerm, false), false
+	}
+
 	// If the request is coming from an old term then reject it.
 	if req.Term < s.currentTerm {
 		s.debugln("server.rv.error: stale term")
@@ -782,30 +1002,66 @@ func (s *Server) processRequestVoteRequest(req *RequestVoteRequest) (*RequestVot
 	return newRequestVoteResponse(s.currentTerm, true), true
 }
 
+// Installs a snapshot sent by the leader. A follower receives this instead
+// of AppendEntries when its nextIndex falls before the leader's oldest
+// retained log entry.
+func (s *Server) InstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse {
+	ret, _ := s.send(req)
+	resp, _ := ret.(*InstallSnapshotResponse)
+	return resp
+}
+
+// Receives one chunk of a streaming InstallSnapshot transfer. A follower
+// receives a sequence of these instead of a single InstallSnapshotRequest
+// when the leader's snapshot crosses StreamingSnapshotThreshold.
+func (s *Server) SnapshotChunk(req *SnapshotChunkRequest) *SnapshotChunkResponse {
+	ret, _ := s.send(req)
+	resp, _ := ret.(*SnapshotChunkResponse)
+	return resp
+}
+
+// Requests a pre-vote from a server. Unlike RequestVote, granting a
+// pre-vote never updates the recipient's term or votedFor.
+func (s *Server) PreVote(req *PreVoteRequest) *PreVoteResponse {
+	ret, _ := s.send(req)
+	resp, _ := ret.(*PreVoteResponse)
+	return resp
+}
+
 //--------------------------------------
 // Membership
 //--------------------------------------
 
 // Adds a peer to the server. This should be called by a system's join command
 // within the context so that it is within the context of the server lock.
+//
+// This is now a thin wrapper that drives SetConfiguration's joint-consensus
+// change for the common single-peer case when called on a running leader;
+// AddPeer/RemovePeer used to mutate s.peers directly, which could violate
+// safety if invoked on a partitioned leader racing another membership
+// change. Internal recovery paths that run on the event loop goroutine
+// itself (SnapshotRecovery, InstallSnapshot, LoadSnapshot) use addPeerLocal
+// instead, since routing through SetConfiguration there would deadlock the
+// loop waiting on its own channel.
 func (s *Server) AddPeer(name string) error {
-	// Do not allow peers to be added twice.
-
 	if s.peers[name] != nil {
 		return DuplicatePeerError
 	}
+	if s.name == name {
+		return nil
+	}
 
-	// Only add the peer if it doesn't have the same name.
-	if s.name != name {
-		//s.debugln("Add peer ", name)
-		peer := newPeer(s, name, s.heartbeatTimeout)
-		if s.State() == Leader {
-			peer.startHeartbeat()
-		}
-		s.peers[peer.name] = peer
+	if s.State() != Leader {
+		s.addPeerLocal(name)
+		return nil
 	}
 
-	return nil
+	names := make([]string, 0, len(s.peers)+2)
+	names = append(names, s.name, name)
+	for existing := range s.peers {
+		names = append(names, existing)
+	}
+	return s.SetConfiguration(names)
 }
 
 // Removes a peer from the server. This should be called by a system's join command
@@ -821,113 +1077,200 @@ func (s *Server) RemovePeer(name string) error {
 		return fmt.Errorf("raft: Peer not found: %s", name)
 	}
 
-	// TODO: Flush entries to the peer first.
+	// If the peer has fallen behind the retained log, send it the latest
+	// snapshot before dropping it. Log entries after the snapshot are not
+	// sent here, and a failed snapshot send does not stop the removal.
+	if peer.getPrevLogIndex() < s.log.startIndex {
+		s.installSnapshotToPeer(peer)
+	}
 
-	// Stop peer and remove it.
-	peer.stopHeartbeat()
-	delete(s.peers, name)
+	if s.State() != Leader {
+		peer.stopHeartbeat()
+		delete(s.peers, name)
+		return nil
+	}
 
-	return nil
+	names := make([]string, 0, len(s.peers))
+	names = append(names, s.name)
+	for existing := range s.peers {
+		if existing != name {
+			names = append(names, existing)
+		}
+	}
+	return s.SetConfiguration(names)
+}
+
+// Adds a peer directly to the live peer map without going through the log.
+// Used by recovery paths that already run on the event loop goroutine,
+// where the replicated path AddPeer normally takes would deadlock.
+func (s *Server) addPeerLocal(name string) {
+	if s.name == name || s.peers[name] != nil {
+		return
+	}
+	peer := newPeer(s, name, s.heartbeatTimeout)
+	if s.state == Leader {
+		peer.startHeartbeat()
+	}
+	s.peers[peer.name] = peer
 }
 
 //--------------------------------------
 // Log compaction
 //--------------------------------------
 
-// The background snapshot function
+// The background snapshot function. Runs takeSnapshot periodically, or
+// right away whenever TriggerSnapshot fires (typically because
+// SnapshotThreshold entries have been applied since the last snapshot).
 func (s *Server) Snapshot() {
 	for {
-		// TODO: change this... to something reasonable
-		time.Sleep(60 * time.Second)
+		select {
+		case <-time.After(60 * time.Second):
+		case <-s.snapshotTriggerc:
+		}
 
 		s.takeSnapshot()
 	}
 }
 
+// Takes a new snapshot of the current commit point. The heavy lifting
+// (stateMachine.Save, fsync, rename) happens on the dedicated snapshotter
+// goroutine; takeSnapshot only marks a snapshot in-flight, hands off the
+// metadata needed to build it, and waits on notifyc before compacting the
+// log, so log.compact never runs until the snapshot is durably on disk.
 func (s *Server) takeSnapshot() error {
-	//TODO put a snapshot mutex
 	s.debugln("take Snapshot")
+
+	s.mutex.Lock()
 	if s.currentSnapshot != nil {
+		s.mutex.Unlock()
 		return errors.New("handling snapshot")
 	}
 
 	lastIndex, lastTerm := s.log.commitInfo()
-
 	if lastIndex == 0 || lastTerm == 0 {
+		s.mutex.Unlock()
 		return errors.New("No logs")
 	}
 
-	path := s.SnapshotPath(lastIndex, lastTerm)
-
-	var state []byte
-	var err error
-
-	if s.stateMachine != nil {
-		state, err = s.stateMachine.Save()
-
-		if err != nil {
-			return err
-		}
-
-	} else {
-		state = []byte{0}
-	}
-
 	var peerNames []string
-
 	for _, peer := range s.peers {
 		peerNames = append(peerNames, peer.Name())
 	}
 	peerNames = append(peerNames, s.Name())
 
-	s.currentSnapshot = &Snapshot{lastIndex, lastTerm, peerNames, state, path}
+	s.currentSnapshot = &Snapshot{LastIndex: lastIndex, LastTerm: lastTerm}
+	s.mutex.Unlock()
+
+	notifyc := make(chan struct{})
+	job := &snapshotApply{
+		lastIndex: lastIndex,
+		lastTerm:  lastTerm,
+		peerNames: peerNames,
+		notifyc:   notifyc,
+	}
+	s.snapshotApplyc <- job
+	<-notifyc
 
-	s.saveSnapshot()
+	if job.err != nil {
+		return job.err
+	}
 
 	s.log.compact(lastIndex, lastTerm)
 
 	return nil
 }
 
-// Retrieves the log path for the server.
-func (s *Server) saveSnapshot() error {
-
-	if s.currentSnapshot == nil {
-		return errors.New("no snapshot to save")
-	}
-
-	err := s.currentSnapshot.save()
-
+// Persists snapshot via the server's SnapshotStore, then swaps it in as
+// s.lastSnapshot and prunes old snapshots down to SnapshotRetain. Called
+// only from the snapshotter goroutine, and never while holding s.mutex
+// across the store write itself.
+func (s *Server) saveSnapshot(snapshot *Snapshot) error {
+	sink, err := s.snapshotStore.Create(snapshot.LastIndex, snapshot.LastTerm, snapshot.Peers)
 	if err != nil {
 		return err
 	}
 
-	tmp := s.lastSnapshot
-	s.lastSnapshot = s.currentSnapshot
+	if _, err := sink.Write(snapshot.State); err != nil {
+		sink.Cancel()
+		return err
+	}
 
-	// delete the previous snapshot if there is any change
-	if tmp != nil && !(tmp.LastIndex == s.lastSnapshot.LastIndex && tmp.LastTerm == s.lastSnapshot.LastTerm) {
-		tmp.remove()
+	if err := sink.Close(); err != nil {
+		return err
 	}
+
+	s.mutex.Lock()
+	s.lastSnapshot = snapshot
 	s.currentSnapshot = nil
+	s.mutex.Unlock()
+
+	// The new snapshot is durably stored by now, so pruning older ones
+	// here can never leave the cluster with zero snapshots.
+	s.reapSnapshots()
+
 	return nil
 }
 
-// Retrieves the log path for the server.
+// Retrieves how many snapshots reapSnapshots keeps.
+func (s *Server) SnapshotRetain() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshotRetain
+}
+
+// Sets how many snapshots reapSnapshots keeps. Values below 1 are clamped
+// to 1, since a server must always retain its most recent snapshot.
+func (s *Server) SetSnapshotRetain(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.mutex.Lock()
+	store := s.snapshotStore
+	s.snapshotRetain = n
+	s.mutex.Unlock()
+
+	if fileStore, ok := store.(*FileSnapshotStore); ok {
+		fileStore.setRetain(n)
+	}
+}
+
+// Deletes all but the SnapshotRetain newest snapshots via the server's
+// SnapshotStore. Called after a new snapshot has been durably stored, so a
+// failure partway through pruning at worst leaves an extra old snapshot
+// around rather than none at all.
+func (s *Server) reapSnapshots() {
+	if err := s.snapshotStore.Reap(); err != nil {
+		s.debugln("raft: unable to reap snapshots: ", err)
+	}
+}
+
+// Retrieves the on-disk path for the snapshot at the given index/term. This
+// is only meaningful while the server is using the default
+// FileSnapshotStore: the InstallSnapshot and SnapshotChunk receive paths
+// write the received snapshot to this path, and installSnapshotToPeer reads
+// the snapshot it sends from it, both bypassing SnapshotStore. With a
+// different store, a snapshot received from a peer is kept outside that
+// store, and a snapshot taken locally has no file here to send.
 func (s *Server) SnapshotPath(lastIndex uint64, lastTerm uint64) string {
 	return path.Join(s.path, "snapshot", fmt.Sprintf("%v_%v.ss", lastTerm, lastIndex))
 }
 
+// Installs a whole-state snapshot sent by the leader. Applying it to the
+// state machine and updating term/commit index happen under s.mutex as
+// before, but persisting the snapshot to disk is handed off to the
+// snapshotter goroutine: SnapshotRecovery only blocks Raft progress until
+// the write is enqueued, not until fsync+rename finish, while log.compact
+// still only runs once that's confirmed done via notifyc. A watchdog logs
+// progress and aborts with an error instead of blocking the follower
+// indefinitely if the snapshotter goroutine hangs.
 func (s *Server) SnapshotRecovery(req *SnapshotRequest) (*SnapshotResponse, error) {
-	//
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 
 	s.stateMachine.Recovery(req.State)
 
 	//recovery the cluster configuration
 	for _, peerName := range req.Peers {
-		s.AddPeer(peerName)
+		s.addPeerLocal(peerName)
 	}
 
 	//update term and index
@@ -935,98 +1278,91 @@ func (s *Server) SnapshotRecovery(req *SnapshotRequest) (*SnapshotResponse, erro
 
 	s.log.updateCommitIndex(req.LastIndex)
 
-	snapshotPath := s.SnapshotPath(req.LastIndex, req.LastTerm)
+	s.currentSnapshot = &Snapshot{LastIndex: req.LastIndex, LastTerm: req.LastTerm}
+	s.mutex.Unlock()
+
+	s.recordSnapshotAttempt()
+	s.recordSnapshotProgress(uint64(len(req.State)))
+
+	notifyc := make(chan struct{})
+	job := &snapshotApply{
+		lastIndex: req.LastIndex,
+		lastTerm:  req.LastTerm,
+		peerNames: req.Peers,
+		state:     req.State,
+		notifyc:   notifyc,
+	}
+	s.snapshotApplyc <- job
 
-	s.currentSnapshot = &Snapshot{req.LastIndex, req.LastTerm, req.Peers, req.State, snapshotPath}
+	stalledc := s.watchSnapshotProgress("recv from "+req.LeaderName, notifyc)
 
-	s.saveSnapshot()
+	// log.compact must never run before the snapshot is durably on disk.
+	select {
+	case <-notifyc:
+		if job.err != nil {
+			s.recordSnapshotOutcome(false)
+			return nil, job.err
+		}
+		s.recordSnapshotOutcome(true)
+	case err := <-stalledc:
+		s.recordSnapshotOutcome(false)
+		return nil, err
+	}
 
 	s.log.compact(req.LastIndex, req.LastTerm)
 
 	return newSnapshotResponse(req.LastTerm, true, req.LastIndex), nil
-
 }
 
-// Load a snapshot at restart
+// Load a snapshot at restart. Candidates are tried newest to oldest: a
+// snapshot whose checksum doesn't verify is quarantined by the SnapshotStore
+// rather than aborting the load, so a single corrupt file left by a crash
+// mid-write doesn't prevent recovery from an older, still-good one.
 func (s *Server) LoadSnapshot() error {
-	dir, err := os.OpenFile(path.Join(s.path, "snapshot"), os.O_RDONLY, 0)
+	metas, err := s.snapshotStore.List()
 	if err != nil {
-
 		return err
 	}
 
-	filenames, err := dir.Readdirnames(-1)
-
-	if err != nil {
-		dir.Close()
-		panic(err)
-	}
-
-	dir.Close()
-	if len(filenames) == 0 {
+	if len(metas) == 0 {
 		return errors.New("no snapshot")
 	}
 
-	// not sure how many snapshot we should keep
-	sort.Strings(filenames)
-	snapshotPath := path.Join(s.path, "snapshot", filenames[len(filenames)-1])
-
-	// should not fail
-	file, err := os.OpenFile(snapshotPath, os.O_RDONLY, 0)
-	defer file.Close()
-	if err != nil {
-		panic(err)
-	}
-
-	// TODO check checksum first
-
-	var snapshotBytes []byte
-	var checksum uint32
-
-	n, err := fmt.Fscanf(file, "%08x\n", &checksum)
-
-	if err != nil {
-		return err
-	}
-
-	if n != 1 {
-		return errors.New("Bad snapshot file")
-	}
-
-	snapshotBytes, _ = ioutil.ReadAll(file)
-	s.debugln(string(snapshotBytes))
-
-	// Generate checksum.
-	byteChecksum := crc32.ChecksumIEEE(snapshotBytes)
+	var lastErr error
+	for _, meta := range metas {
+		openedMeta, r, err := s.snapshotStore.Open(meta.ID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
 
-	if uint32(checksum) != byteChecksum {
-		s.debugln(checksum, " ", byteChecksum)
-		return errors.New("bad snapshot file")
-	}
+		state, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
 
-	err = json.Unmarshal(snapshotBytes, &s.lastSnapshot)
+		snapshot := &Snapshot{LastIndex: meta.LastIndex, LastTerm: meta.LastTerm, Peers: openedMeta.Peers, State: state, Path: s.SnapshotPath(meta.LastIndex, meta.LastTerm)}
+		s.lastSnapshot = snapshot
 
-	if err != nil {
-		s.debugln("unmarshal error: ", err)
-		return err
-	}
+		if err := s.stateMachine.Recovery(snapshot.State); err != nil {
+			s.debugln("recovery error: ", err)
+			return err
+		}
 
-	err = s.stateMachine.Recovery(s.lastSnapshot.State)
+		for _, peerName := range snapshot.Peers {
+			s.addPeerLocal(peerName)
+		}
 
-	if err != nil {
-		s.debugln("recovery error: ", err)
-		return err
-	}
+		s.log.startTerm = snapshot.LastTerm
+		s.log.startIndex = snapshot.LastIndex
+		s.log.updateCommitIndex(snapshot.LastIndex)
 
-	for _, peerName := range s.lastSnapshot.Peers {
-		s.AddPeer(peerName)
+		return nil
 	}
 
-	s.log.startTerm = s.lastSnapshot.LastTerm
-	s.log.startIndex = s.lastSnapshot.LastIndex
-	s.log.updateCommitIndex(s.lastSnapshot.LastIndex)
-
-	return err
+	return fmt.Errorf("raft: no valid snapshot found: %s", lastErr)
 }
 
 //--------------------------------------
@@ -0,0 +1,87 @@
+package raft
+
+// DefaultSnapshotThreshold is how many log entries may be applied since the
+// last snapshot before the server self-triggers a new one, unless
+// overridden with SetSnapshotThreshold.
+const DefaultSnapshotThreshold = 10000
+
+// A request handed from the Raft goroutine (takeSnapshot or
+// SnapshotRecovery) to the dedicated snapshotter goroutine. State is left
+// nil when the snapshotter should call stateMachine.Save itself (the
+// self-triggered path); it's pre-populated when the caller already has the
+// state in hand, as SnapshotRecovery does after installing a snapshot
+// pushed by the leader. notifyc is closed once the attempt is done, which
+// is the signal the caller waits on; err is set before notifyc closes and
+// must be checked before running log.compact; a failed or partial write
+// must never be followed by compaction.
+type snapshotApply struct {
+	lastIndex uint64
+	lastTerm  uint64
+	peerNames []string
+	state     []byte
+	notifyc   chan struct{}
+	err       error
+}
+
+// Runs for the lifetime of the server, taking snapshot jobs off
+// snapshotApplyc one at a time and performing the slow part -
+// stateMachine.Save, fsync, and rename - off the Raft goroutine. This
+// mirrors etcd's apply{notifyc} fix: the caller that enqueued the job
+// only proceeds to log.compact once notifyc closes, so a crash or a slow
+// disk can never cause compaction to run ahead of a durable snapshot.
+func (s *Server) snapshotter() {
+	for job := range s.snapshotApplyc {
+		state := job.state
+		var err error
+
+		if state == nil {
+			if s.stateMachine != nil {
+				state, err = s.stateMachine.Save()
+			} else {
+				state = []byte{0}
+			}
+		}
+
+		if err == nil {
+			snapshot := &Snapshot{job.lastIndex, job.lastTerm, job.peerNames, state, s.SnapshotPath(job.lastIndex, job.lastTerm)}
+			err = s.saveSnapshot(snapshot)
+		}
+
+		if err != nil {
+			s.debugln("raft: snapshotter: unable to save snapshot: ", err)
+			s.mutex.Lock()
+			s.currentSnapshot = nil
+			s.mutex.Unlock()
+		}
+
+		job.err = err
+		close(job.notifyc)
+	}
+}
+
+// Retrieves how many entries may be applied since the last snapshot before
+// the server self-triggers a new one.
+func (s *Server) SnapshotThreshold() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshotThreshold
+}
+
+// Sets how many entries may be applied since the last snapshot before the
+// server self-triggers a new one.
+func (s *Server) SetSnapshotThreshold(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshotThreshold = n
+}
+
+// TriggerSnapshot asks the server to take a new snapshot as soon as it's
+// convenient, without blocking the caller. It's safe to call from any
+// goroutine; triggers that arrive before a previous one has been picked up
+// collapse into a single snapshot.
+func (s *Server) TriggerSnapshot() {
+	select {
+	case s.snapshotTriggerc <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,40 @@
+package raft
+
+// The request sent to a follower as part of a streaming InstallSnapshot
+// transfer (see installSnapshotToPeerStreaming). Unlike InstallSnapshotRequest,
+// Data is read directly off the state machine's SnapshotWriter rather than a
+// file already materialized on the leader, and Checksum carries the rolling
+// Castagnoli CRC over all bytes sent so far; on the final chunk the
+// follower compares it with a CRC of the whole reassembled temp file, which
+// it reads back for that purpose. Term and LeaderName are
+// carried for the same reason InstallSnapshotRequest carries them: a stale
+// or deposed leader's chunks must be rejected rather than overwriting a
+// follower's newer state.
+type SnapshotChunkRequest struct {
+	Header     `json:"header"`
+	Term       uint64   `json:"term"`
+	LeaderName string   `json:"leaderName"`
+	LastIndex  uint64   `json:"lastIndex"`
+	LastTerm   uint64   `json:"lastTerm"`
+	Peers      []string `json:"peers"`
+	Offset     uint64   `json:"offset"`
+	Data       []byte   `json:"data"`
+	Done       bool     `json:"done"`
+	Checksum   uint32   `json:"checksum"`
+}
+
+// Creates a new SnapshotChunk request.
+func newSnapshotChunkRequest(term uint64, leaderName string, lastIndex uint64, lastTerm uint64, peers []string, offset uint64, data []byte, done bool, checksum uint32) *SnapshotChunkRequest {
+	return &SnapshotChunkRequest{
+		Header:     newHeader(),
+		Term:       term,
+		LeaderName: leaderName,
+		LastIndex:  lastIndex,
+		LastTerm:   lastTerm,
+		Peers:      peers,
+		Offset:     offset,
+		Data:       data,
+		Done:       done,
+		Checksum:   checksum,
+	}
+}
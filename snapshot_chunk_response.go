@@ -0,0 +1,17 @@
+package raft
+
+// The response to a SnapshotChunkRequest.
+type SnapshotChunkResponse struct {
+	Header       `json:"header"`
+	Success      bool   `json:"success"`
+	BytesWritten uint64 `json:"bytesWritten"`
+}
+
+// Creates a new SnapshotChunk response.
+func newSnapshotChunkResponse(success bool, bytesWritten uint64) *SnapshotChunkResponse {
+	return &SnapshotChunkResponse{
+		Header:       newHeader(),
+		Success:      success,
+		BytesWritten: bytesWritten,
+	}
+}
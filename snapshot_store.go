@@ -0,0 +1,47 @@
+package raft
+
+import "io"
+
+// SnapshotMeta describes a stored snapshot without its state, so callers can
+// decide which one to load before paying the cost of reading it.
+type SnapshotMeta struct {
+	ID        string
+	LastIndex uint64
+	LastTerm  uint64
+	Peers     []string
+}
+
+// SnapshotSink is an open handle for writing a new snapshot's state. The
+// caller writes the state machine's bytes to it and calls Close to persist
+// it, or Cancel to discard it. ID reports the identifier the sink will be
+// stored under once closed, for stores (like FileSnapshotStore) that can
+// compute it up front from Create's arguments.
+type SnapshotSink interface {
+	io.Writer
+	ID() string
+	Close() error
+	Cancel() error
+}
+
+// SnapshotStore persists and retrieves the snapshots a Server takes of its
+// state machine. The default is a FileSnapshotStore preserving the
+// <term>_<index>.ss on-disk layout this package has always used; a Server
+// constructed with NewServerWithSnapshotStore can be given an alternative,
+// such as an in-memory store for tests or one backed by object storage.
+type SnapshotStore interface {
+	// Create opens a sink for a new snapshot at the given index/term with
+	// the given peer set. The state machine's bytes should be written to
+	// the returned sink, which is not durable until Close returns nil.
+	Create(lastIndex uint64, lastTerm uint64, peers []string) (SnapshotSink, error)
+
+	// List returns metadata for every snapshot currently stored, newest
+	// first.
+	List() ([]*SnapshotMeta, error)
+
+	// Open returns the metadata and state for the snapshot with the given
+	// ID. The caller must Close the returned reader.
+	Open(id string) (*SnapshotMeta, io.ReadCloser, error)
+
+	// Reap deletes all but the newest SnapshotRetain snapshots.
+	Reap() error
+}
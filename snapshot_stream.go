@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// DefaultStreamingSnapshotThreshold is the snapshot file size above which
+// installSnapshotToPeer switches from buffering the whole snapshot in memory
+// to streaming it in fixed-size chunks straight off the state machine,
+// unless overridden with SetStreamingSnapshotThreshold.
+const DefaultStreamingSnapshotThreshold = 10 * 1024 * 1024
+
+// SnapshotWriter is implemented by a StateMachine that can stream its state
+// to a writer instead of returning it as a single in-memory []byte. A state
+// machine large enough to cross StreamingSnapshotThreshold should implement
+// this so installSnapshotToPeer never has to hold the whole snapshot in
+// memory at once.
+type SnapshotWriter interface {
+	WriteSnapshot(w io.Writer) error
+}
+
+// SnapshotReader is the receive-side counterpart to SnapshotWriter: a state
+// machine that implements it recovers through an io.Reader instead of
+// Recovery's []byte. processSnapshotChunkRequest hands it a reader over the
+// reassembled state, which it has already read into memory.
+type SnapshotReader interface {
+	ReadSnapshot(r io.Reader) error
+}
+
+// Retrieves the snapshot file size above which installSnapshotToPeer streams
+// instead of buffering the whole transfer in memory.
+func (s *Server) StreamingSnapshotThreshold() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.streamingSnapshotThreshold
+}
+
+// Sets the snapshot file size above which installSnapshotToPeer streams
+// instead of buffering the whole transfer in memory.
+func (s *Server) SetStreamingSnapshotThreshold(n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streamingSnapshotThreshold = n
+}
+
+// Streams the current snapshot to peer in fixed-size chunks read directly
+// off the state machine's SnapshotWriter, so the sender never holds the
+// whole FSM state in memory; the receiver reads the reassembled state whole
+// to verify and install it. Used by installSnapshotToPeer in place of the
+// buffered InstallSnapshot transfer once the snapshot crosses
+// StreamingSnapshotThreshold. A watchdog logs progress and aborts the
+// transfer with an error if a chunk round-trip makes no progress for
+// SnapshotStallTimeout, so a wedged peer doesn't hang the sender forever.
+func (s *Server) installSnapshotToPeerStreaming(peer *Peer, sw SnapshotWriter) error {
+	s.mutex.RLock()
+	snapshot := s.lastSnapshot
+	term := s.currentTerm
+	name := s.name
+	s.mutex.RUnlock()
+
+	s.recordSnapshotAttempt()
+
+	donec := make(chan struct{})
+	defer close(donec)
+	stalledc := s.watchSnapshotProgress("send to "+peer.Name(), donec)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sw.WriteSnapshot(pw))
+	}()
+
+	checksum := crc32.Checksum(nil, snapshotChecksumTable)
+	buf := make([]byte, DefaultSnapshotChunkSize)
+	offset := uint64(0)
+
+	for {
+		n, readErr := io.ReadFull(pr, buf)
+		done := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+		if readErr != nil && !done {
+			s.recordSnapshotOutcome(false)
+			return fmt.Errorf("raft: Unable to read snapshot for streaming: %s", readErr)
+		}
+
+		chunk := buf[:n]
+		checksum = crc32.Update(checksum, snapshotChecksumTable, chunk)
+
+		req := newSnapshotChunkRequest(term, name, snapshot.LastIndex, snapshot.LastTerm, snapshot.Peers, offset, chunk, done, checksum)
+
+		type chunkResult struct {
+			resp *SnapshotChunkResponse
+			err  error
+		}
+		resultc := make(chan chunkResult, 1)
+		go func() {
+			resp, err := s.transporter.SendSnapshotChunkRequest(s, peer, req)
+			resultc <- chunkResult{resp, err}
+		}()
+
+		var result chunkResult
+		select {
+		case result = <-resultc:
+		case err := <-stalledc:
+			s.recordSnapshotOutcome(false)
+			return err
+		}
+
+		if result.err != nil {
+			s.recordSnapshotOutcome(false)
+			return result.err
+		}
+		if !result.resp.Success {
+			s.recordSnapshotOutcome(false)
+			return fmt.Errorf("raft: Peer %s rejected snapshot chunk at offset %d", peer.Name(), offset)
+		}
+
+		offset += uint64(n)
+		s.recordSnapshotProgress(offset)
+
+		if done {
+			break
+		}
+	}
+
+	s.recordSnapshotOutcome(true)
+	peer.setPrevLogIndex(snapshot.LastIndex)
+	return nil
+}
+
+// Processes a SnapshotChunkRequest: chunks are appended to a temp file holding
+// the raw FSM state; once Done is set the rolling checksum is validated, the
+// reassembled state is wrapped in the same on-disk Snapshot format
+// writeSnapshotFile produces (so FileSnapshotStore can read it back after a
+// restart), and the state machine recovers from it.
+func (s *Server) processSnapshotChunkRequest(req *SnapshotChunkRequest) (*SnapshotChunkResponse, bool) {
+	if err := checkRPCHeader(req.Header); err != nil {
+		s.debugln("server.sc.error: ", err)
+		return newSnapshotChunkResponse(false, 0), false
+	}
+
+	if req.Term < s.currentTerm {
+		s.debugln("server.sc.error: stale term")
+		return newSnapshotChunkResponse(false, 0), false
+	}
+
+	s.setCurrentTerm(req.Term, req.LeaderName, true)
+
+	tmpPath := s.SnapshotPath(req.LastIndex, req.LastTerm) + ".raw.tmp"
+
+	if err := appendSnapshotChunk(tmpPath, req.Offset, req.Data); err != nil {
+		s.debugln("server.sc.write.error: ", err)
+		return newSnapshotChunkResponse(false, req.Offset), true
+	}
+
+	if !req.Done {
+		return newSnapshotChunkResponse(true, req.Offset+uint64(len(req.Data))), true
+	}
+
+	body, err := os.ReadFile(tmpPath)
+	if err != nil {
+		s.debugln("server.sc.read.error: ", err)
+		return newSnapshotChunkResponse(false, req.Offset), true
+	}
+
+	if crc32.Checksum(body, snapshotChecksumTable) != req.Checksum {
+		os.Remove(tmpPath)
+		s.debugln("server.sc.checksum.error")
+		return newSnapshotChunkResponse(false, req.Offset), true
+	}
+
+	finalPath := s.SnapshotPath(req.LastIndex, req.LastTerm)
+	snapshot := &Snapshot{LastIndex: req.LastIndex, LastTerm: req.LastTerm, Peers: req.Peers, State: body, Path: finalPath}
+	if err := writeSnapshotFile(snapshot); err != nil {
+		os.Remove(tmpPath)
+		s.debugln("server.sc.write.error: ", err)
+		return newSnapshotChunkResponse(false, req.Offset), true
+	}
+	os.Remove(tmpPath)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sr, ok := s.stateMachine.(SnapshotReader); ok {
+		if err := sr.ReadSnapshot(bytes.NewReader(body)); err != nil {
+			s.debugln("server.sc.recovery.error: ", err)
+			return newSnapshotChunkResponse(false, req.Offset), true
+		}
+	} else if err := s.stateMachine.Recovery(body); err != nil {
+		s.debugln("server.sc.recovery.error: ", err)
+		return newSnapshotChunkResponse(false, req.Offset), true
+	}
+
+	for _, peerName := range req.Peers {
+		s.addPeerLocal(peerName)
+	}
+
+	s.lastSnapshot = snapshot
+	s.log.startTerm = req.LastTerm
+	s.log.startIndex = req.LastIndex
+	s.log.updateCommitIndex(req.LastIndex)
+	s.log.compact(req.LastIndex, req.LastTerm)
+
+	return newSnapshotChunkResponse(true, req.Offset+uint64(len(req.Data))), true
+}
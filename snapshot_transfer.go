@@ -0,0 +1,187 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrIndexTooLow describes the case where the leader's PrevLogIndex for a
+// peer falls before the first entry the leader still retains, i.e. the
+// entry the peer needs has already been compacted into a snapshot and
+// installSnapshotToPeer is the way to catch it up. No code in this package
+// returns it.
+var ErrIndexTooLow = errors.New("raft: Required index is too low, snapshot needed")
+
+// The size of each chunk streamed by installSnapshotToPeer. Keeping chunks
+// small bounds the memory held by both ends while a snapshot is in flight
+// and lets the watchdog report meaningful progress.
+const DefaultSnapshotChunkSize = 64 * 1024
+
+// Sends the leader's most recent snapshot to peer in fixed-size chunks and,
+// once the peer has acknowledged the final chunk, sets the peer's
+// prevLogIndex to the snapshot's LastIndex. RemovePeer calls it for a peer
+// that has fallen behind the retained log; the peer's AppendEntries flusher
+// does not call it, and it neither stops nor restarts the peer's
+// heartbeats. Snapshots
+// larger than StreamingSnapshotThreshold are sent via the SnapshotChunk
+// protocol straight off the state machine's SnapshotWriter instead of being
+// buffered in memory first, provided the state machine implements it.
+func (s *Server) installSnapshotToPeer(peer *Peer) error {
+	s.mutex.RLock()
+	snapshot := s.lastSnapshot
+	term := s.currentTerm
+	name := s.name
+	s.mutex.RUnlock()
+
+	if snapshot == nil {
+		return errors.New("raft: No snapshot available to install on peer " + peer.Name())
+	}
+
+	if info, err := os.Stat(snapshot.Path); err == nil && info.Size() > s.StreamingSnapshotThreshold() {
+		if sw, ok := s.stateMachine.(SnapshotWriter); ok {
+			return s.installSnapshotToPeerStreaming(peer, sw)
+		}
+	}
+
+	data, err := os.ReadFile(snapshot.Path)
+	if err != nil {
+		return fmt.Errorf("raft: Unable to read snapshot for streaming: %s", err)
+	}
+	offset := uint64(0)
+
+	for {
+		end := offset + DefaultSnapshotChunkSize
+		done := end >= uint64(len(data))
+		if done {
+			end = uint64(len(data))
+		}
+
+		req := newInstallSnapshotRequest(term, name, snapshot.LastIndex, snapshot.LastTerm, snapshot.Peers, offset, data[offset:end], done)
+		resp, err := s.transporter.SendInstallSnapshotRequest(s, peer, req)
+		if err != nil {
+			return err
+		}
+		if !resp.Success {
+			return fmt.Errorf("raft: Peer %s rejected install snapshot chunk at offset %d", peer.Name(), offset)
+		}
+		s.setPeerProtocolVersion(peer.Name(), resp.ProtocolVersion)
+
+		if done {
+			break
+		}
+		offset = end
+	}
+
+	// The peer is now caught up through the snapshot; resume heartbeats
+	// from just after the snapshot's last entry.
+	peer.setPrevLogIndex(snapshot.LastIndex)
+	return nil
+}
+
+// Processes an InstallSnapshot request from the leader. Chunks are appended
+// to a temp file; once Done is set the file is validated and handed to the
+// state machine, and the log is rewound to start just after the snapshot.
+func (s *Server) processInstallSnapshotRequest(req *InstallSnapshotRequest) (*InstallSnapshotResponse, bool) {
+	if err := checkRPCHeader(req.Header); err != nil {
+		s.debugln("server.is.error: ", err)
+		return newInstallSnapshotResponse(s.currentTerm, false, 0), false
+	}
+
+	if req.Term < s.currentTerm {
+		s.debugln("server.is.error: stale term")
+		return newInstallSnapshotResponse(s.currentTerm, false, 0), false
+	}
+
+	s.setCurrentTerm(req.Term, req.LeaderName, true)
+
+	tmpPath := s.SnapshotPath(req.LastIndex, req.LastTerm) + ".tmp"
+
+	if err := appendSnapshotChunk(tmpPath, req.Offset, req.Data); err != nil {
+		s.debugln("server.is.write.error: ", err)
+		return newInstallSnapshotResponse(s.currentTerm, false, req.Offset), true
+	}
+
+	if !req.Done {
+		return newInstallSnapshotResponse(s.currentTerm, true, req.Offset+uint64(len(req.Data))), true
+	}
+
+	finalPath := s.SnapshotPath(req.LastIndex, req.LastTerm)
+	state, err := finalizeSnapshotFile(tmpPath, finalPath)
+	if err != nil {
+		s.debugln("server.is.finalize.error: ", err)
+		return newInstallSnapshotResponse(s.currentTerm, false, req.Offset), true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.stateMachine.Recovery(state); err != nil {
+		s.debugln("server.is.recovery.error: ", err)
+		return newInstallSnapshotResponse(s.currentTerm, false, req.Offset), true
+	}
+
+	for _, peerName := range req.PeerNames {
+		s.addPeerLocal(peerName)
+	}
+
+	s.currentTerm = req.LastTerm
+	s.lastSnapshot = &Snapshot{req.LastIndex, req.LastTerm, req.PeerNames, state, finalPath}
+	s.log.startTerm = req.LastTerm
+	s.log.startIndex = req.LastIndex
+	s.log.updateCommitIndex(req.LastIndex)
+
+	return newInstallSnapshotResponse(s.currentTerm, true, req.Offset+uint64(len(req.Data))), true
+}
+
+// Appends a chunk of an incoming snapshot transfer to the temp file at the
+// given offset, creating it if this is the first chunk.
+func appendSnapshotChunk(tmpPath string, offset uint64, data []byte) error {
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(data, int64(offset)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Validates the reassembled snapshot file's checksum and, on success,
+// renames it into place and returns the decoded FSM state. The bad file is
+// removed on failure so a corrupt transfer doesn't linger in the snapshot
+// directory.
+func finalizeSnapshotFile(tmpPath string, finalPath string) ([]byte, error) {
+	snapshotBytes, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var checksum uint32
+	n, err := fmt.Sscanf(string(snapshotBytes), "%08x\n", &checksum)
+	if err != nil || n != 1 {
+		os.Remove(tmpPath)
+		return nil, errors.New("raft: Bad snapshot transfer: missing checksum header")
+	}
+
+	var snapshot Snapshot
+	body := snapshotBytes[9:]
+	if !verifySnapshotChecksum(checksum, body) {
+		os.Remove(tmpPath)
+		return nil, errors.New("raft: Snapshot transfer checksum mismatch")
+	}
+
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return nil, err
+	}
+
+	return snapshot.State, nil
+}
@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefaultSnapshotProgressLogInterval is how often an in-flight snapshot
+// transfer logs its progress.
+const DefaultSnapshotProgressLogInterval = 10 * time.Second
+
+// DefaultSnapshotStallTimeout is how long a snapshot transfer may go
+// without progress before it's aborted, unless overridden with
+// SetSnapshotStallTimeout.
+const DefaultSnapshotStallTimeout = 60 * time.Second
+
+// Retrieves how long a snapshot transfer may go without progress before
+// it's aborted.
+func (s *Server) SnapshotStallTimeout() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshotStallTimeout
+}
+
+// Sets how long a snapshot transfer may go without progress before it's
+// aborted.
+func (s *Server) SetSnapshotStallTimeout(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshotStallTimeout = d
+}
+
+// Stats reports counters for monitoring snapshot transfers, keyed the way
+// an operator would name them in a metrics system: snapshot_bytes_in_flight,
+// snapshot_last_progress_unix, snapshot_attempts_total and
+// snapshot_failures_total.
+func (s *Server) Stats() map[string]string {
+	s.snapshotStatsMutex.Lock()
+	bytesInFlight := s.snapshotBytesInFlight
+	lastProgress := s.snapshotLastProgress
+	attempts := s.snapshotAttemptsTotal
+	failures := s.snapshotFailuresTotal
+	s.snapshotStatsMutex.Unlock()
+
+	return map[string]string{
+		"snapshot_bytes_in_flight":    strconv.FormatUint(bytesInFlight, 10),
+		"snapshot_last_progress_unix": strconv.FormatInt(lastProgress.Unix(), 10),
+		"snapshot_attempts_total":     strconv.FormatUint(attempts, 10),
+		"snapshot_failures_total":     strconv.FormatUint(failures, 10),
+	}
+}
+
+// Marks the start of a new snapshot transfer (either direction) for the
+// purposes of Stats() and the stall watchdog.
+func (s *Server) recordSnapshotAttempt() {
+	s.snapshotStatsMutex.Lock()
+	defer s.snapshotStatsMutex.Unlock()
+	s.snapshotAttemptsTotal++
+	s.snapshotBytesInFlight = 0
+	s.snapshotLastProgress = time.Now()
+}
+
+// Records that bytes (a cumulative total, not a delta) have been
+// transferred for the in-flight snapshot, resetting the stall clock.
+func (s *Server) recordSnapshotProgress(bytes uint64) {
+	s.snapshotStatsMutex.Lock()
+	defer s.snapshotStatsMutex.Unlock()
+	s.snapshotBytesInFlight = bytes
+	s.snapshotLastProgress = time.Now()
+}
+
+// Marks the in-flight snapshot transfer finished, successfully or not.
+func (s *Server) recordSnapshotOutcome(success bool) {
+	s.snapshotStatsMutex.Lock()
+	defer s.snapshotStatsMutex.Unlock()
+	s.snapshotBytesInFlight = 0
+	if !success {
+		s.snapshotFailuresTotal++
+	}
+}
+
+// How long it's been since the in-flight snapshot last made progress.
+func (s *Server) snapshotSinceProgress() time.Duration {
+	s.snapshotStatsMutex.Lock()
+	defer s.snapshotStatsMutex.Unlock()
+	return time.Since(s.snapshotLastProgress)
+}
+
+// Logs label's transfer progress every DefaultSnapshotProgressLogInterval
+// until donec closes, and delivers an error on the returned channel the
+// first time SnapshotStallTimeout passes without progress. Modeled on
+// Dgraph's watchdog for stuck snapshots in both directions: the caller
+// selects between its own completion signal and this channel so a hung
+// transfer aborts instead of blocking forever.
+func (s *Server) watchSnapshotProgress(label string, donec <-chan struct{}) <-chan error {
+	stalledc := make(chan error, 1)
+
+	go func() {
+		start := time.Now()
+		logTicker := time.NewTicker(DefaultSnapshotProgressLogInterval)
+		defer logTicker.Stop()
+		stallTicker := time.NewTicker(time.Second)
+		defer stallTicker.Stop()
+
+		for {
+			select {
+			case <-donec:
+				return
+			case <-logTicker.C:
+				stats := s.Stats()
+				s.debugln("raft: snapshot ", label, ": ", stats["snapshot_bytes_in_flight"], " bytes transferred, elapsed ", time.Since(start))
+			case <-stallTicker.C:
+				if since := s.snapshotSinceProgress(); since > s.SnapshotStallTimeout() {
+					stalledc <- fmt.Errorf("raft: snapshot %s: no progress for %s, aborting", label, since)
+					return
+				}
+			}
+		}
+	}()
+
+	return stalledc
+}